@@ -3,17 +3,16 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	kafka "github.com/segmentio/kafka-go"
-	scram "github.com/segmentio/kafka-go/sasl/scram"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,11 +21,30 @@ const supportedWebhookVersion = "4"
 type (
 	AlertmanagerKafkaExporter struct {
 		kafkaWriter *kafka.Writer
+		transformer Transformer
+		spool       *diskSpool
+		auth        requestAuthenticator
+
+		// tlsReloaderCancel stops the background goroutine ConnectKafka
+		// starts to keep the Kafka TLS key pair/CA bundle hot-reloaded.
+		tlsReloaderCancel context.CancelFunc
+
+		producerCfg   ProducerConfig
+		syncWaitersMu sync.Mutex
+		syncWaiters   map[string]*syncWaiter
 
 		prometheus struct {
-			alertsReceived   *prometheus.CounterVec
-			alertsInvalid    *prometheus.CounterVec
-			alertsSuccessful *prometheus.CounterVec
+			alertsReceived         *prometheus.CounterVec
+			alertsInvalid          *prometheus.CounterVec
+			alertsSuccessful       *prometheus.CounterVec
+			alertsSpooled          *prometheus.CounterVec
+			alertsReplayed         *prometheus.CounterVec
+			alertsDroppedSpoolFull *prometheus.CounterVec
+			spoolSizeBytes         prometheus.GaugeFunc
+			spoolAgeSeconds        prometheus.GaugeFunc
+			producerQueueDepth     prometheus.Gauge
+			producerBatchSize      prometheus.Histogram
+			producerWriteLatency   prometheus.Histogram
 		}
 	}
 
@@ -35,13 +53,43 @@ type (
 		CertFile   string
 		KeyFile    string
 		CACertFile string
+
+		// CACertDir, if set, is loaded instead of CACertFile as a directory of
+		// PEM-encoded CA certificates.
+		CACertDir string
+
+		// InsecureSkipVerify disables server certificate verification
+		// entirely. ServerName overrides the hostname used for verification
+		// and SNI, for brokers fronted by a load balancer or reachable via an
+		// IP that does not match their certificate.
+		InsecureSkipVerify bool
+		ServerName         string
+
+		// ReloadInterval controls how often the key pair and CA bundle are
+		// re-read from disk. Defaults to defaultTLSReloadInterval.
+		ReloadInterval time.Duration
 	}
 
 	KafkaSaslConfig struct {
 		SecurityProtocol string
-		SaslMechanism string
-		ScramUsername string
-		ScramPassword string
+		SaslMechanism    string
+		ScramUsername    string
+		ScramPassword    string
+
+		// OauthTokenProvider selects the TokenProvider used for the OAUTHBEARER
+		// mechanism: "static" or "oidc". Defaults to "static".
+		OauthTokenProvider string
+		// OauthStaticToken is used by the "static" provider. If empty,
+		// OauthStaticTokenEnv is consulted instead.
+		OauthStaticToken    string
+		OauthStaticTokenEnv string
+
+		// OIDC client_credentials settings used by the "oidc" provider.
+		OauthTokenURL      string
+		OauthClientID      string
+		OauthClientSecret  string
+		OauthScope         string
+		OauthRefreshBefore time.Duration
 	}
 
 	AlertmanagerEntry struct {
@@ -82,7 +130,7 @@ func (e *AlertmanagerKafkaExporter) Init() {
 			Name: "alertmanager2kafka_alerts_invalid",
 			Help: "alertmanager2kafka invalid alerts",
 		},
-		[]string{},
+		[]string{"reason"},
 	)
 	prometheus.MustRegister(e.prometheus.alertsInvalid)
 
@@ -96,87 +144,124 @@ func (e *AlertmanagerKafkaExporter) Init() {
 	prometheus.MustRegister(e.prometheus.alertsSuccessful)
 }
 
-func (e *AlertmanagerKafkaExporter) ConnectKafka(host string, topic string, sslConfig *KafkaSSLConfig, saslConfig *KafkaSaslConfig) {
+func (e *AlertmanagerKafkaExporter) ConnectKafka(host string, topic string, sslConfig *KafkaSSLConfig, saslConfig *KafkaSaslConfig, producerConfig ProducerConfig) {
+	if e.tlsReloaderCancel != nil {
+		e.tlsReloaderCancel()
+	}
+	reloaderCtx, cancel := context.WithCancel(context.Background())
+	e.tlsReloaderCancel = cancel
+
 	dialer := kafka.DefaultDialer
 	log.Debugf("Starting Kafka connection")
 	if sslConfig.EnableSSL {
-		cert, err := tls.LoadX509KeyPair(sslConfig.CertFile, sslConfig.KeyFile)
-		if err != nil {
-			log.Fatalf("cannot load SSL key/certificate pair (key=%s, cert=%s): %s", sslConfig.KeyFile, sslConfig.CertFile, err)
-		}
-
-		if sslConfig.CACertFile == "" {
+		if sslConfig.CACertFile == "" && sslConfig.CACertDir == "" {
 			sslConfig.CACertFile = "/etc/ssl/certs/ca-certificates.crt"
 		}
 
-		caCertPEM, err := ioutil.ReadFile(sslConfig.CACertFile)
+		reloader, err := newTLSReloader(sslConfig.CertFile, sslConfig.KeyFile, sslConfig.CACertFile, sslConfig.CACertDir, sslConfig.ServerName)
 		if err != nil {
-			log.Fatalf("cannot read SSL CA certificate file %s: %s", sslConfig.CACertFile, err)
+			log.Fatalf("cannot initialize TLS reloader: %s", err)
 		}
+		go reloader.Start(reloaderCtx, sslConfig.ReloadInterval)
 
-		caCertPool := x509.NewCertPool()
-		if ok := caCertPool.AppendCertsFromPEM([]byte(caCertPEM)); !ok {
-			log.Fatalf("cannot load SSL CA certificates from file %s: %s", sslConfig.CACertFile, err)
-		}
-
-		log.Infof("configured client-side SSL: key=%s, cert=%s, cacert=%s", sslConfig.KeyFile, sslConfig.CertFile, sslConfig.CACertFile)
+		log.Infof("configured client-side SSL: key=%s, cert=%s, cacert=%s, cacertdir=%s, servername=%s", sslConfig.KeyFile, sslConfig.CertFile, sslConfig.CACertFile, sslConfig.CACertDir, sslConfig.ServerName)
 		dialer.TLS = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			RootCAs:      caCertPool,
+			ServerName:           sslConfig.ServerName,
+			GetClientCertificate: reloader.GetClientCertificate,
+			InsecureSkipVerify:   true,
+		}
+		if sslConfig.InsecureSkipVerify {
+			log.Warnf("TLS certificate verification is disabled (InsecureSkipVerify=true)")
+		} else {
+			dialer.TLS.VerifyPeerCertificate = reloader.VerifyPeerCertificate
 		}
 	}
 
 	if strings.Contains(saslConfig.SecurityProtocol, "SASL") {
-		log.Debugf("Configuring SASL")
-		if strings.Contains(saslConfig.SaslMechanism, "SCRAM") {
-			log.Debugf("Configuring SCRAM")
-			if saslConfig.ScramUsername == "" || saslConfig.ScramPassword == "" {
-				log.Fatalf("Username and password have to be provided if Sasl mechanism is scram")
-			}			
-
-			
-			if ! sslConfig.EnableSSL {
-
-				if sslConfig.CACertFile == "" {
-					sslConfig.CACertFile = "/etc/ssl/certs/ca-certificates.crt"
-				}
-				
-				caCertPEM, err := ioutil.ReadFile(sslConfig.CACertFile)
-				if err != nil {
-					log.Fatalf("cannot read SSL CA certificate file %s: %s", sslConfig.CACertFile, err)
-				}
-				
-				caCertPool := x509.NewCertPool()
-				if ok := caCertPool.AppendCertsFromPEM([]byte(caCertPEM)); !ok {
-					log.Fatalf("cannot load SSL CA certificates from file %s: %s", sslConfig.CACertFile, err)
-				}
-
-				log.Infof("configured client-side SSL: cacert=%s", sslConfig.CACertFile)
-				dialer.TLS = &tls.Config{
-					RootCAs:      caCertPool,
-				}
+		log.Debugf("Configuring SASL (mechanism=%s)", saslConfig.SaslMechanism)
+
+		if !sslConfig.EnableSSL && dialer.TLS == nil {
+			if sslConfig.CACertFile == "" && sslConfig.CACertDir == "" {
+				sslConfig.CACertFile = "/etc/ssl/certs/ca-certificates.crt"
 			}
 
-			mechanism, err := scram.Mechanism(scram.SHA512, saslConfig.ScramUsername, saslConfig.ScramPassword)
-			dialer.SASLMechanism = mechanism
+			// SASL_SSL without a client certificate: go through the same hot
+			// reloader and CACertDir/ServerName/InsecureSkipVerify machinery
+			// as the mTLS branch above, since this is the common case for
+			// managed Kafka (Confluent Cloud, MSK, Aliyun) SASL_SSL endpoints.
+			reloader, err := newTLSReloader("", "", sslConfig.CACertFile, sslConfig.CACertDir, sslConfig.ServerName)
 			if err != nil {
-				panic(err)
+				log.Fatalf("cannot initialize TLS reloader: %s", err)
 			}
+			go reloader.Start(reloaderCtx, sslConfig.ReloadInterval)
+
+			log.Infof("configured SASL_SSL: cacert=%s, cacertdir=%s, servername=%s", sslConfig.CACertFile, sslConfig.CACertDir, sslConfig.ServerName)
+			dialer.TLS = &tls.Config{
+				ServerName:         sslConfig.ServerName,
+				InsecureSkipVerify: true,
+			}
+			if sslConfig.InsecureSkipVerify {
+				log.Warnf("TLS certificate verification is disabled (InsecureSkipVerify=true)")
+			} else {
+				dialer.TLS.VerifyPeerCertificate = reloader.VerifyPeerCertificate
+			}
+		}
+
+		mechanism, err := newSaslMechanism(saslConfig)
+		if err != nil {
+			log.Fatalf("cannot configure SASL mechanism %q: %s", saslConfig.SaslMechanism, err)
+		}
+		dialer.SASLMechanism = mechanism
+	}
+
+	// dialer is only used as a convenient place to assemble the TLS config
+	// and SASL mechanism above; the writer itself dials through a
+	// kafka.Transport, not a kafka.Dialer, so it can run in async mode with
+	// a Completion callback.
+	e.producerCfg = producerConfig
+	e.newProducerState()
+
+	transport := &kafka.Transport{
+		TLS:  dialer.TLS,
+		SASL: dialer.SASLMechanism,
+	}
+
+	writer, err := e.buildWriter(strings.Split(host, ","), transport, producerConfig)
+	if err != nil {
+		log.Fatalf("cannot configure kafka producer: %s", err)
+	}
+	e.kafkaWriter = writer
+
+	if e.transformer == nil {
+		transformer, err := NewPipelineTransformer(TransformConfig{DefaultTopic: topic})
+		if err != nil {
+			log.Fatalf("cannot build default transformer: %s", err)
 		}
+		e.transformer = transformer
 	}
+}
 
-	e.kafkaWriter = kafka.NewWriter(kafka.WriterConfig{
-		Brokers: strings.Split(host, ","),
-		Topic:   topic,
-		Dialer:  dialer,
-	})
+// SetTransformer overrides the Transformer used to turn a received
+// AlertmanagerEntry into outgoing Kafka messages. Call it before
+// ConnectKafka to opt out of the default single-message, unkeyed pipeline.
+func (e *AlertmanagerKafkaExporter) SetTransformer(t Transformer) {
+	e.transformer = t
+}
+
+// Close stops the background TLS reloader goroutine started by ConnectKafka.
+// Call it on graceful shutdown, or it is called automatically before a
+// subsequent ConnectKafka replaces the connection.
+func (e *AlertmanagerKafkaExporter) Close() {
+	if e.tlsReloaderCancel != nil {
+		e.tlsReloaderCancel()
+	}
 }
 
 func (e *AlertmanagerKafkaExporter) HttpHandler(w http.ResponseWriter, r *http.Request) {
 	e.prometheus.alertsReceived.WithLabelValues().Inc()
 
 	if r.Body == nil {
-		e.prometheus.alertsInvalid.WithLabelValues().Inc()
+		e.prometheus.alertsInvalid.WithLabelValues("empty_body").Inc()
 		err := errors.New("got empty request body")
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		log.Error(err)
@@ -185,24 +270,33 @@ func (e *AlertmanagerKafkaExporter) HttpHandler(w http.ResponseWriter, r *http.R
 
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		e.prometheus.alertsInvalid.WithLabelValues().Inc()
+		e.prometheus.alertsInvalid.WithLabelValues("read_error").Inc()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Error(err)
 		return
 	}
 	defer r.Body.Close()
 
+	if e.auth != nil {
+		if reason, err := e.auth.Authenticate(r, b); err != nil {
+			e.prometheus.alertsInvalid.WithLabelValues(reason).Inc()
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			log.Error(err)
+			return
+		}
+	}
+
 	var msg AlertmanagerEntry
 	err = json.Unmarshal(b, &msg)
 	if err != nil {
-		e.prometheus.alertsInvalid.WithLabelValues().Inc()
+		e.prometheus.alertsInvalid.WithLabelValues("parse_error").Inc()
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		log.Error(err)
 		return
 	}
 
 	if msg.Version != supportedWebhookVersion {
-		e.prometheus.alertsInvalid.WithLabelValues().Inc()
+		e.prometheus.alertsInvalid.WithLabelValues("unsupported_version").Inc()
 		err := fmt.Errorf("do not understand webhook version %q, only version %q is supported", msg.Version, supportedWebhookVersion)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		log.Error(err)
@@ -212,16 +306,51 @@ func (e *AlertmanagerKafkaExporter) HttpHandler(w http.ResponseWriter, r *http.R
 	now := time.Now()
 	msg.Timestamp = now.Format(time.RFC3339)
 
-	incidentJson, _ := json.Marshal(msg)
-	err = e.kafkaWriter.WriteMessages(context.Background(), kafka.Message{Value: incidentJson})
+	messages, err := e.transformer.Transform(msg)
 	if err != nil {
-		switch kafkaErr := err.(type) {
-		case kafka.WriteErrors:
-			err = kafkaErr[0]
+		e.prometheus.alertsInvalid.WithLabelValues("transform_error").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Error(err)
+		return
+	}
+
+	if len(messages) == 0 {
+		log.Debugf("alert dropped by transform pipeline: %v", msg.CommonLabels)
+		e.prometheus.alertsSuccessful.WithLabelValues().Inc()
+		return
+	}
+
+	sync := isSyncRequest(r)
+	ctx, cancel := context.WithTimeout(context.Background(), e.writeTimeout(sync))
+	defer cancel()
+
+	err = e.writeMessages(ctx, msg.GroupKey, messages, sync)
+	if err != nil {
+		var alreadySpooled *errAlreadySpooled
+		if errors.As(err, &alreadySpooled) {
+			log.Warnf("unable to write into kafka, already spooled for later replay: %s", err)
+			e.prometheus.alertsSuccessful.WithLabelValues().Inc()
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		if e.spool != nil {
+			if spoolErr := e.spoolMessages(msg.GroupKey, messages); spoolErr != nil {
+				e.prometheus.alertsDroppedSpoolFull.WithLabelValues().Inc()
+				errMsg := fmt.Errorf("unable to write into kafka and cannot spool: %s (kafka error: %s)", spoolErr, err)
+				http.Error(w, errMsg.Error(), http.StatusServiceUnavailable)
+				log.Error(errMsg)
+				return
+			}
+
+			log.Warnf("unable to write into kafka, spooled for later replay: %s", err)
+			e.prometheus.alertsSuccessful.WithLabelValues().Inc()
+			w.WriteHeader(http.StatusAccepted)
+			return
 		}
 
 		errMsg := fmt.Errorf("unable to write into kafka: %s", err)
-		e.prometheus.alertsInvalid.WithLabelValues().Inc()
+		e.prometheus.alertsInvalid.WithLabelValues("kafka_write_error").Inc()
 		http.Error(w, errMsg.Error(), http.StatusBadRequest)
 		log.Error(errMsg)
 		return
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHMACHeader          = "X-Signature"
+	defaultHMACTimestampHeader = "X-Signature-Timestamp"
+	defaultHMACMaxClockSkew    = 5 * time.Minute
+	defaultJWKSRefreshInterval = 10 * time.Minute
+)
+
+type (
+	// AuthConfig selects and configures one authentication mode for
+	// HttpHandler. Mode must be "bearer", "hmac" or "mtls"; any other value
+	// is rejected by SetAuth.
+	AuthConfig struct {
+		Mode   string
+		Bearer BearerAuthConfig
+		HMAC   HMACAuthConfig
+		MTLS   MTLSAuthConfig
+	}
+
+	// BearerAuthConfig accepts either a static shared token or JWTs signed
+	// by a JWKS-published RSA key.
+	BearerAuthConfig struct {
+		StaticToken    string
+		StaticTokenEnv string
+
+		JWKSURL         string
+		Issuer          string
+		Audience        string
+		RefreshInterval time.Duration
+	}
+
+	// HMACAuthConfig verifies an HMAC-SHA256 signature over the raw request
+	// body, computed over "<timestamp>.<body>" so a captured request can't
+	// be replayed outside MaxClockSkew of when it was signed.
+	HMACAuthConfig struct {
+		Secret              string
+		HeaderName          string
+		TimestampHeaderName string
+		MaxClockSkew        time.Duration
+	}
+
+	// MTLSAuthConfig anchors client certificate verification to a CA bundle
+	// and optionally restricts which SANs/CNs are accepted. If both
+	// CACertFile and CACertDir are set, CACertDir is used and CACertFile is
+	// ignored, same as KafkaSSLConfig.
+	MTLSAuthConfig struct {
+		CACertFile  string
+		CACertDir   string
+		AllowedSANs []string
+		AllowedCNs  []string
+	}
+
+	// requestAuthenticator checks an inbound webhook request. On failure it
+	// returns a short machine-readable reason used as the alertsInvalid
+	// "reason" label, alongside a human-readable error.
+	requestAuthenticator interface {
+		Authenticate(r *http.Request, body []byte) (reason string, err error)
+	}
+)
+
+// SetAuth validates cfg and wires the matching requestAuthenticator into
+// the exporter. Call it before serving traffic through HttpHandler.
+func (e *AlertmanagerKafkaExporter) SetAuth(cfg AuthConfig) error {
+	switch strings.ToLower(cfg.Mode) {
+	case "bearer":
+		auth, err := newBearerAuthenticator(cfg.Bearer)
+		if err != nil {
+			return err
+		}
+		e.auth = auth
+	case "hmac":
+		auth, err := newHMACAuthenticator(cfg.HMAC)
+		if err != nil {
+			return err
+		}
+		e.auth = auth
+	case "mtls":
+		auth, err := newMTLSAuthenticator(cfg.MTLS)
+		if err != nil {
+			return err
+		}
+		e.auth = auth
+	default:
+		return fmt.Errorf("unsupported auth mode %q, supported: bearer, hmac, mtls", cfg.Mode)
+	}
+	return nil
+}
+
+// BuildServerTLSConfig returns the tls.Config an http.Server must use to
+// require and verify client certificates for MTLSAuthConfig. It is separate
+// from SetAuth because the TLS handshake happens before any
+// requestAuthenticator runs; callers hand this to http.Server.TLSConfig and
+// still call SetAuth to enforce the SAN/CN allowlist per request.
+func BuildServerTLSConfig(cfg MTLSAuthConfig) (*tls.Config, error) {
+	pool, err := loadCABundle(cfg.CACertFile, cfg.CACertDir)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// --- bearer ---
+
+type bearerAuthenticator struct {
+	staticToken string
+	verifier    *jwtVerifier
+}
+
+func newBearerAuthenticator(cfg BearerAuthConfig) (*bearerAuthenticator, error) {
+	a := &bearerAuthenticator{}
+
+	if cfg.StaticToken != "" || cfg.StaticTokenEnv != "" {
+		token := cfg.StaticToken
+		if token == "" {
+			token = os.Getenv(cfg.StaticTokenEnv)
+		}
+		if token == "" {
+			return nil, fmt.Errorf("bearer auth: StaticTokenEnv %q is not set", cfg.StaticTokenEnv)
+		}
+		a.staticToken = token
+		return a, nil
+	}
+
+	if cfg.JWKSURL == "" {
+		return nil, fmt.Errorf("bearer auth: either StaticToken/StaticTokenEnv or JWKSURL has to be set")
+	}
+
+	refresh := cfg.RefreshInterval
+	if refresh <= 0 {
+		refresh = defaultJWKSRefreshInterval
+	}
+
+	verifier, err := newJWTVerifier(cfg.JWKSURL, cfg.Issuer, cfg.Audience, refresh)
+	if err != nil {
+		return nil, err
+	}
+	a.verifier = verifier
+
+	return a, nil
+}
+
+func (a *bearerAuthenticator) Authenticate(r *http.Request, _ []byte) (string, error) {
+	header := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return "unauthenticated", fmt.Errorf("missing or malformed Authorization header")
+	}
+	token := strings.TrimPrefix(header, prefix)
+
+	if a.staticToken != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.staticToken)) != 1 {
+			return "unauthenticated", fmt.Errorf("bearer token does not match")
+		}
+		return "", nil
+	}
+
+	if err := a.verifier.Verify(token); err != nil {
+		if err == errJWTExpired {
+			return "expired", err
+		}
+		return "unauthenticated", err
+	}
+
+	return "", nil
+}
+
+// --- hmac ---
+
+type hmacAuthenticator struct {
+	secret       []byte
+	header       string
+	tsHeader     string
+	maxClockSkew time.Duration
+}
+
+func newHMACAuthenticator(cfg HMACAuthConfig) (*hmacAuthenticator, error) {
+	if cfg.Secret == "" {
+		return nil, fmt.Errorf("hmac auth: Secret must be set")
+	}
+
+	header := cfg.HeaderName
+	if header == "" {
+		header = defaultHMACHeader
+	}
+	tsHeader := cfg.TimestampHeaderName
+	if tsHeader == "" {
+		tsHeader = defaultHMACTimestampHeader
+	}
+	maxClockSkew := cfg.MaxClockSkew
+	if maxClockSkew <= 0 {
+		maxClockSkew = defaultHMACMaxClockSkew
+	}
+
+	return &hmacAuthenticator{
+		secret:       []byte(cfg.Secret),
+		header:       header,
+		tsHeader:     tsHeader,
+		maxClockSkew: maxClockSkew,
+	}, nil
+}
+
+func (a *hmacAuthenticator) Authenticate(r *http.Request, body []byte) (string, error) {
+	signature := r.Header.Get(a.header)
+	if signature == "" {
+		return "unauthenticated", fmt.Errorf("missing %s header", a.header)
+	}
+
+	tsHeader := r.Header.Get(a.tsHeader)
+	if tsHeader == "" {
+		return "unauthenticated", fmt.Errorf("missing %s header", a.tsHeader)
+	}
+	ts, err := strconv.ParseInt(tsHeader, 10, 64)
+	if err != nil {
+		return "unauthenticated", fmt.Errorf("invalid %s header: %w", a.tsHeader, err)
+	}
+
+	signedAt := time.Unix(ts, 0)
+	if skew := time.Since(signedAt); skew > a.maxClockSkew || skew < -a.maxClockSkew {
+		return "expired", fmt.Errorf("%s is outside the allowed clock skew of %s", a.tsHeader, a.maxClockSkew)
+	}
+
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(tsHeader))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	got, err := base64OrHexDecode(signature)
+	if err != nil || !hmac.Equal(expected, got) {
+		return "bad_signature", fmt.Errorf("%s does not match the computed HMAC", a.header)
+	}
+
+	return "", nil
+}
+
+func base64OrHexDecode(s string) ([]byte, error) {
+	if decoded, err := hexDecode(s); err == nil {
+		return decoded, nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+func hexDecode(s string) ([]byte, error) {
+	if len(s)%2 != 0 {
+		return nil, fmt.Errorf("odd-length hex string")
+	}
+	out := make([]byte, len(s)/2)
+	for i := 0; i < len(out); i++ {
+		b, err := strconv.ParseUint(s[i*2:i*2+2], 16, 8)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = byte(b)
+	}
+	return out, nil
+}
+
+// --- mtls ---
+
+type mtlsAuthenticator struct {
+	allowedSANs map[string]struct{}
+	allowedCNs  map[string]struct{}
+}
+
+func newMTLSAuthenticator(cfg MTLSAuthConfig) (*mtlsAuthenticator, error) {
+	a := &mtlsAuthenticator{
+		allowedSANs: toSet(cfg.AllowedSANs),
+		allowedCNs:  toSet(cfg.AllowedCNs),
+	}
+	return a, nil
+}
+
+func toSet(values []string) map[string]struct{} {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+func (a *mtlsAuthenticator) Authenticate(r *http.Request, _ []byte) (string, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "unauthenticated", fmt.Errorf("no client certificate presented")
+	}
+
+	if len(a.allowedSANs) == 0 && len(a.allowedCNs) == 0 {
+		return "", nil
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+
+	if _, ok := a.allowedCNs[cert.Subject.CommonName]; ok {
+		return "", nil
+	}
+	for _, san := range cert.DNSNames {
+		if _, ok := a.allowedSANs[san]; ok {
+			return "", nil
+		}
+	}
+
+	return "unauthenticated", fmt.Errorf("client certificate CN %q / SANs %v are not in the allowlist", cert.Subject.CommonName, cert.DNSNames)
+}
+
+// --- JWT/JWKS ---
+
+var errJWTExpired = fmt.Errorf("token is expired")
+
+// jwtVerifier validates RS256-signed JWTs against keys published on a JWKS
+// endpoint, refreshing the key set periodically and lazily on an unknown
+// kid so a key rotation doesn't require restarting the exporter.
+type jwtVerifier struct {
+	jwksURL  string
+	issuer   string
+	audience string
+
+	httpClient *http.Client
+
+	mu       sync.RWMutex
+	keys     map[string]*rsa.PublicKey
+	fetched  time.Time
+	interval time.Duration
+}
+
+func newJWTVerifier(jwksURL, issuer, audience string, interval time.Duration) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		jwksURL:    jwksURL,
+		issuer:     issuer,
+		audience:   audience,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		interval:   interval,
+	}
+	if err := v.refresh(); err != nil {
+		return nil, fmt.Errorf("cannot load JWKS from %s: %w", jwksURL, err)
+	}
+	return v, nil
+}
+
+func (v *jwtVerifier) refresh() error {
+	resp, err := v.httpClient.Get(v.jwksURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS endpoint returned status %d", resp.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("cannot decode JWKS response: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		pub, err := rsaPublicKeyFromJWK(k.N, k.E)
+		if err != nil {
+			log.Warnf("skipping unusable JWK %q: %s", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.fetched = time.Now()
+	v.mu.Unlock()
+
+	return nil
+}
+
+func rsaPublicKeyFromJWK(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %w", err)
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %w", err)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nb),
+		E: int(new(big.Int).SetBytes(eb).Int64()),
+	}, nil
+}
+
+func (v *jwtVerifier) keyFor(kid string) *rsa.PublicKey {
+	v.mu.RLock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetched) > v.interval
+	v.mu.RUnlock()
+
+	if ok && !stale {
+		return key
+	}
+
+	if err := v.refresh(); err != nil {
+		log.Warnf("cannot refresh JWKS: %s", err)
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.keys[kid]
+}
+
+// Verify checks an RS256 JWT's signature, issuer, audience and exp/nbf
+// claims.
+func (v *jwtVerifier) Verify(token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("invalid JWT header: %w", err)
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return fmt.Errorf("invalid JWT header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unsupported JWT algorithm %q, only RS256 is supported", header.Alg)
+	}
+
+	key := v.keyFor(header.Kid)
+	if key == nil {
+		return fmt.Errorf("unknown JWT key id %q", header.Kid)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid JWT signature encoding: %w", err)
+	}
+
+	signedInput := parts[0] + "." + parts[1]
+	sum := sha256.Sum256([]byte(signedInput))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature); err != nil {
+		return fmt.Errorf("JWT signature verification failed: %w", err)
+	}
+
+	var claims struct {
+		Iss string      `json:"iss"`
+		Aud jwtAudience `json:"aud"`
+		Exp int64       `json:"exp"`
+		Nbf int64       `json:"nbf"`
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return fmt.Errorf("invalid JWT claims: %w", err)
+	}
+
+	now := time.Now()
+	if claims.Exp != 0 && now.After(time.Unix(claims.Exp, 0)) {
+		return errJWTExpired
+	}
+	if claims.Nbf != 0 && now.Before(time.Unix(claims.Nbf, 0)) {
+		return fmt.Errorf("token is not yet valid")
+	}
+	if v.issuer != "" && claims.Iss != v.issuer {
+		return fmt.Errorf("unexpected issuer %q", claims.Iss)
+	}
+	if v.audience != "" && !claims.Aud.contains(v.audience) {
+		return fmt.Errorf("unexpected audience %v", []string(claims.Aud))
+	}
+
+	return nil
+}
+
+// jwtAudience accepts the JWT "aud" claim in either of its common shapes: a
+// single string or an array of strings (Auth0, Okta and Azure AD all emit
+// the latter for multi-audience tokens).
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return fmt.Errorf("aud claim must be a string or an array of strings: %w", err)
+	}
+	*a = jwtAudience(multi)
+	return nil
+}
+
+func (a jwtAudience) contains(audience string) bool {
+	for _, v := range a {
+		if v == audience {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBearerAuthenticatorStaticToken(t *testing.T) {
+	auth, err := newBearerAuthenticator(BearerAuthConfig{StaticToken: "s3cr3t"})
+	if err != nil {
+		t.Fatalf("newBearerAuthenticator: %s", err)
+	}
+
+	ok := httptest.NewRequest(http.MethodPost, "/", nil)
+	ok.Header.Set("Authorization", "Bearer s3cr3t")
+	if _, err := auth.Authenticate(ok, nil); err != nil {
+		t.Fatalf("expected the matching static token to authenticate, got %s", err)
+	}
+
+	bad := httptest.NewRequest(http.MethodPost, "/", nil)
+	bad.Header.Set("Authorization", "Bearer wrong")
+	if _, err := auth.Authenticate(bad, nil); err == nil {
+		t.Fatalf("expected a mismatched static token to be rejected")
+	}
+
+	missing := httptest.NewRequest(http.MethodPost, "/", nil)
+	if _, err := auth.Authenticate(missing, nil); err == nil {
+		t.Fatalf("expected a missing Authorization header to be rejected")
+	}
+}
+
+func mustRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate RSA key: %s", err)
+	}
+	return key
+}
+
+func jwksServer(t *testing.T, pub *rsa.PublicKey, kid string) *httptest.Server {
+	t.Helper()
+	n := base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{"kid": kid, "kty": "RSA", "n": n, "e": e}},
+		})
+	}))
+}
+
+func signTestJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+
+	headerJSON, err := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	if err != nil {
+		t.Fatalf("marshal header: %s", err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %s", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	sum := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatalf("sign JWT: %s", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// TestBearerAuthenticatorJWTWithArrayAudience guards against regressing the
+// aud claim fix: Auth0/Okta/Azure AD commonly emit "aud" as a JSON array.
+func TestBearerAuthenticatorJWTWithArrayAudience(t *testing.T) {
+	key := mustRSAKey(t)
+	const kid = "test-key"
+
+	server := jwksServer(t, &key.PublicKey, kid)
+	defer server.Close()
+
+	auth, err := newBearerAuthenticator(BearerAuthConfig{
+		JWKSURL:  server.URL,
+		Issuer:   "https://issuer.example.com",
+		Audience: "alertmanager2kafka",
+	})
+	if err != nil {
+		t.Fatalf("newBearerAuthenticator: %s", err)
+	}
+
+	token := signTestJWT(t, key, kid, map[string]interface{}{
+		"iss": "https://issuer.example.com",
+		"aud": []string{"other-service", "alertmanager2kafka"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if _, err := auth.Authenticate(req, nil); err != nil {
+		t.Fatalf("expected a JWT with an array audience to authenticate, got %s", err)
+	}
+}
+
+func TestBearerAuthenticatorJWTExpired(t *testing.T) {
+	key := mustRSAKey(t)
+	const kid = "test-key"
+
+	server := jwksServer(t, &key.PublicKey, kid)
+	defer server.Close()
+
+	auth, err := newBearerAuthenticator(BearerAuthConfig{JWKSURL: server.URL})
+	if err != nil {
+		t.Fatalf("newBearerAuthenticator: %s", err)
+	}
+
+	token := signTestJWT(t, key, kid, map[string]interface{}{
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if _, err := auth.Authenticate(req, nil); err == nil {
+		t.Fatalf("expected an expired JWT to be rejected")
+	}
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	auth, err := newHMACAuthenticator(HMACAuthConfig{Secret: "shh"})
+	if err != nil {
+		t.Fatalf("newHMACAuthenticator: %s", err)
+	}
+
+	body := []byte(`{"status":"firing"}`)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte("shh"))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set(defaultHMACHeader, sig)
+	req.Header.Set(defaultHMACTimestampHeader, ts)
+	if _, err := auth.Authenticate(req, body); err != nil {
+		t.Fatalf("expected a valid HMAC signature to authenticate, got %s", err)
+	}
+
+	if _, err := auth.Authenticate(req, append([]byte(nil), "tampered"...)); err == nil {
+		t.Fatalf("expected a tampered body to fail HMAC verification")
+	}
+}
+
+func TestMTLSAuthenticator(t *testing.T) {
+	auth, err := newMTLSAuthenticator(MTLSAuthConfig{AllowedCNs: []string{"allowed-client"}})
+	if err != nil {
+		t.Fatalf("newMTLSAuthenticator: %s", err)
+	}
+
+	allowed := &x509.Certificate{Subject: pkix.Name{CommonName: "allowed-client"}}
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{allowed}}
+	if _, err := auth.Authenticate(req, nil); err != nil {
+		t.Fatalf("expected an allowlisted CN to authenticate, got %s", err)
+	}
+
+	denied := &x509.Certificate{Subject: pkix.Name{CommonName: "other-client"}}
+	reqDenied := httptest.NewRequest(http.MethodPost, "/", nil)
+	reqDenied.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{denied}}
+	if _, err := auth.Authenticate(reqDenied, nil); err == nil {
+		t.Fatalf("expected a non-allowlisted CN to be rejected")
+	}
+
+	noCert := httptest.NewRequest(http.MethodPost, "/", nil)
+	if _, err := auth.Authenticate(noCert, nil); err == nil {
+		t.Fatalf("expected a request with no client certificate to be rejected")
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	kafka "github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	headerEnqueuedAt = "x-a2k-enqueued-at"
+	headerSyncID     = "x-a2k-sync-id"
+	// headerGroupKey carries AlertmanagerEntry.GroupKey on outgoing
+	// messages so onWriteCompletion can spool a failed async batch without
+	// needing to look the originating webhook call back up.
+	headerGroupKey = "x-a2k-group-key"
+
+	defaultWriteTimeout = 10 * time.Second
+	defaultSyncTimeout  = 30 * time.Second
+)
+
+// ProducerConfig configures the batching async kafka.Writer built by
+// ConnectKafka. The writer always runs in async mode so a webhook call
+// never blocks on broker acks; callers that need strict durability for a
+// single request opt in with the sync query param/header instead.
+type ProducerConfig struct {
+	BatchSize    int
+	BatchTimeout time.Duration
+	BatchBytes   int64
+	// RequiredAcks is "none", "one" or "all". Defaults to "one".
+	RequiredAcks string
+	// Compression is "", "gzip", "snappy", "lz4" or "zstd". Empty disables
+	// compression.
+	Compression string
+	// WriteTimeout bounds how long a single HttpHandler call waits for its
+	// messages to be handed to the writer (and, for sync requests, for the
+	// broker to acknowledge them).
+	WriteTimeout time.Duration
+}
+
+func requiredAcksFromString(s string) (kafka.RequiredAcks, error) {
+	switch strings.ToLower(s) {
+	case "", "one":
+		return kafka.RequireOne, nil
+	case "none":
+		return kafka.RequireNone, nil
+	case "all":
+		return kafka.RequireAll, nil
+	default:
+		return 0, fmt.Errorf("unsupported RequiredAcks %q, supported: none, one, all", s)
+	}
+}
+
+func compressionFromString(s string) (kafka.Compression, bool, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return 0, false, nil
+	case "gzip":
+		return kafka.Gzip, true, nil
+	case "snappy":
+		return kafka.Snappy, true, nil
+	case "lz4":
+		return kafka.Lz4, true, nil
+	case "zstd":
+		return kafka.Zstd, true, nil
+	default:
+		return 0, false, fmt.Errorf("unsupported Compression %q, supported: gzip, snappy, lz4, zstd", s)
+	}
+}
+
+// syncWaiter tracks the outstanding messages of one sync=true request so
+// its Completion callback invocations (which may be interleaved with other
+// requests' batches) can be told apart.
+type syncWaiter struct {
+	mu        sync.Mutex
+	remaining int
+	err       error
+	// spooled is set once onWriteCompletion has durably spooled a failed
+	// batch that this waiter's messages were part of, so writeMessages can
+	// tell HttpHandler not to spool the same messages again.
+	spooled bool
+	done    chan struct{}
+}
+
+// errAlreadySpooled wraps a synchronous write's Kafka error when
+// onWriteCompletion already durably spooled the failed batch on this
+// waiter's behalf, so HttpHandler knows not to spool it a second time.
+type errAlreadySpooled struct {
+	err error
+}
+
+func (e *errAlreadySpooled) Error() string { return e.err.Error() }
+func (e *errAlreadySpooled) Unwrap() error { return e.err }
+
+func (e *AlertmanagerKafkaExporter) newProducerState() {
+	e.syncWaiters = make(map[string]*syncWaiter)
+
+	e.prometheus.producerQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "alertmanager2kafka_producer_queue_depth",
+		Help: "alertmanager2kafka number of messages handed to the kafka writer but not yet completed",
+	})
+	prometheus.MustRegister(e.prometheus.producerQueueDepth)
+
+	e.prometheus.producerBatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "alertmanager2kafka_producer_batch_size",
+		Help:    "alertmanager2kafka number of messages per completed kafka write batch",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	prometheus.MustRegister(e.prometheus.producerBatchSize)
+
+	e.prometheus.producerWriteLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "alertmanager2kafka_producer_write_latency_seconds",
+		Help:    "alertmanager2kafka time between a message being enqueued and its write completing",
+		Buckets: prometheus.DefBuckets,
+	})
+	prometheus.MustRegister(e.prometheus.producerWriteLatency)
+}
+
+// buildWriter constructs the async kafka.Writer used for the lifetime of
+// the exporter, wiring its Completion callback back into producer metrics
+// and the on-disk spool.
+func (e *AlertmanagerKafkaExporter) buildWriter(brokers []string, transport *kafka.Transport, cfg ProducerConfig) (*kafka.Writer, error) {
+	acks, err := requiredAcksFromString(cfg.RequiredAcks)
+	if err != nil {
+		return nil, err
+	}
+	compression, useCompression, err := compressionFromString(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	// Writer.Topic is deliberately left empty: every message produced by the
+	// Transformer pipeline (chunk0-3) already carries its own Topic, and
+	// kafka.Writer rejects messages that set Topic when Writer.Topic is
+	// also set.
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Transport:    transport,
+		Async:        true,
+		BatchSize:    cfg.BatchSize,
+		BatchBytes:   cfg.BatchBytes,
+		BatchTimeout: cfg.BatchTimeout,
+		RequiredAcks: acks,
+	}
+	if useCompression {
+		writer.Compression = compression
+	}
+
+	writer.Completion = e.onWriteCompletion
+
+	return writer, nil
+}
+
+// onWriteCompletion is the kafka.Writer Completion callback: it records
+// producer metrics for the batch, wakes up any sync=true requests it
+// belongs to, and spools messages that failed to write.
+func (e *AlertmanagerKafkaExporter) onWriteCompletion(messages []kafka.Message, err error) {
+	e.prometheus.producerBatchSize.Observe(float64(len(messages)))
+	e.prometheus.producerQueueDepth.Sub(float64(len(messages)))
+
+	now := time.Now()
+	syncCounts := make(map[string]int)
+
+	for _, m := range messages {
+		if enqueuedAt, ok := headerValue(m.Headers, headerEnqueuedAt); ok {
+			if nanos, parseErr := strconv.ParseInt(enqueuedAt, 10, 64); parseErr == nil {
+				e.prometheus.producerWriteLatency.Observe(now.Sub(time.Unix(0, nanos)).Seconds())
+			}
+		}
+		if syncID, ok := headerValue(m.Headers, headerSyncID); ok {
+			syncCounts[syncID]++
+		}
+	}
+
+	spooled := false
+	if err != nil {
+		log.Warnf("kafka async write batch failed: %s", err)
+		if e.spool != nil {
+			if spoolErr := e.spoolCompletedBatch(messages); spoolErr != nil {
+				e.prometheus.alertsDroppedSpoolFull.WithLabelValues().Inc()
+				log.Errorf("cannot spool failed async write batch: %s", spoolErr)
+			} else {
+				spooled = true
+			}
+		}
+	}
+
+	// kafka-go merges messages from concurrent WriteMessages calls into one
+	// physical batch before invoking Completion, so a batch can carry
+	// several distinct sync IDs (or mix sync and non-sync traffic); only
+	// the messages actually tagged with a given syncID count toward it.
+	for syncID, count := range syncCounts {
+		e.resolveSyncWaiter(syncID, count, err, spooled)
+	}
+}
+
+func (e *AlertmanagerKafkaExporter) spoolCompletedBatch(messages []kafka.Message) error {
+	for _, m := range messages {
+		groupKey, _ := headerValue(m.Headers, headerGroupKey)
+		spoolErr := e.spool.Enqueue(spooledMessage{
+			GroupKey:   groupKey,
+			Topic:      m.Topic,
+			Key:        m.Key,
+			Value:      m.Value,
+			EnqueuedAt: time.Now(),
+		})
+		if spoolErr != nil {
+			return spoolErr
+		}
+		e.prometheus.alertsSpooled.WithLabelValues().Inc()
+	}
+	return nil
+}
+
+func headerValue(headers []kafka.Header, key string) (string, bool) {
+	for _, h := range headers {
+		if h.Key == key {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
+
+func (e *AlertmanagerKafkaExporter) registerSyncWaiter(syncID string, count int) *syncWaiter {
+	w := &syncWaiter{remaining: count, done: make(chan struct{})}
+
+	e.syncWaitersMu.Lock()
+	e.syncWaiters[syncID] = w
+	e.syncWaitersMu.Unlock()
+
+	return w
+}
+
+func (e *AlertmanagerKafkaExporter) resolveSyncWaiter(syncID string, completed int, err error, spooled bool) {
+	e.syncWaitersMu.Lock()
+	w, ok := e.syncWaiters[syncID]
+	e.syncWaitersMu.Unlock()
+	if !ok {
+		return
+	}
+
+	w.mu.Lock()
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	if spooled {
+		w.spooled = true
+	}
+	w.remaining -= completed
+	done := w.remaining <= 0
+	w.mu.Unlock()
+
+	if !done {
+		return
+	}
+
+	e.syncWaitersMu.Lock()
+	delete(e.syncWaiters, syncID)
+	e.syncWaitersMu.Unlock()
+
+	close(w.done)
+}
+
+// writeMessages hands messages to the async writer. When sync is true it
+// blocks (bounded by the context deadline) until every message's batch has
+// completed, returning the first write error if any; otherwise it returns
+// as soon as the messages are queued.
+func (e *AlertmanagerKafkaExporter) writeMessages(ctx context.Context, groupKey string, messages []kafka.Message, sync bool) error {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	var syncID string
+	var waiter *syncWaiter
+	if sync {
+		syncID = randomID()
+		waiter = e.registerSyncWaiter(syncID, len(messages))
+	}
+
+	for i := range messages {
+		messages[i].Headers = append(messages[i].Headers,
+			kafka.Header{Key: headerEnqueuedAt, Value: []byte(now)},
+			kafka.Header{Key: headerGroupKey, Value: []byte(groupKey)},
+		)
+		if sync {
+			messages[i].Headers = append(messages[i].Headers, kafka.Header{Key: headerSyncID, Value: []byte(syncID)})
+		}
+	}
+
+	e.prometheus.producerQueueDepth.Add(float64(len(messages)))
+
+	if err := e.kafkaWriter.WriteMessages(ctx, messages...); err != nil {
+		e.prometheus.producerQueueDepth.Sub(float64(len(messages)))
+		if sync {
+			e.syncWaitersMu.Lock()
+			delete(e.syncWaiters, syncID)
+			e.syncWaitersMu.Unlock()
+		}
+		return err
+	}
+
+	if !sync {
+		return nil
+	}
+
+	select {
+	case <-waiter.done:
+		waiter.mu.Lock()
+		err := waiter.err
+		spooled := waiter.spooled
+		waiter.mu.Unlock()
+		if err != nil && spooled {
+			return &errAlreadySpooled{err: err}
+		}
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for synchronous kafka write: %w", ctx.Err())
+	}
+}
+
+func randomID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// isSyncRequest reports whether a webhook call asked for flush-and-wait
+// semantics, via either a "sync=true" query parameter or an "X-Sync: true"
+// header.
+func isSyncRequest(r *http.Request) bool {
+	if v := r.URL.Query().Get("sync"); v != "" {
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	if v := r.Header.Get("X-Sync"); v != "" {
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return false
+}
+
+// writeTimeout returns the configured per-request deadline for both sync and
+// async requests. If none was configured, it returns defaultWriteTimeout, or
+// the longer defaultSyncTimeout for synchronous requests since they
+// additionally wait for the broker acknowledgement, not just for the message
+// to be queued.
+func (e *AlertmanagerKafkaExporter) writeTimeout(sync bool) time.Duration {
+	if e.producerCfg.WriteTimeout > 0 {
+		return e.producerCfg.WriteTimeout
+	}
+	if sync {
+		return defaultSyncTimeout
+	}
+	return defaultWriteTimeout
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// TokenProvider supplies a bearer token for the OAUTHBEARER SASL mechanism.
+// It mirrors the proxy-initiated OAuth pattern used by kafka-proxy: callers
+// obtain a fresh token on demand and the mechanism itself never needs to
+// know how the token was produced.
+type TokenProvider interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// newSaslMechanism dispatches on saslConfig.SaslMechanism and builds the
+// matching kafka-go SASL mechanism.
+func newSaslMechanism(saslConfig *KafkaSaslConfig) (sasl.Mechanism, error) {
+	switch strings.ToUpper(saslConfig.SaslMechanism) {
+	case "PLAIN":
+		if saslConfig.ScramUsername == "" || saslConfig.ScramPassword == "" {
+			return nil, fmt.Errorf("username and password have to be provided for sasl mechanism PLAIN")
+		}
+		return plain.Mechanism{
+			Username: saslConfig.ScramUsername,
+			Password: saslConfig.ScramPassword,
+		}, nil
+	case "SCRAM-SHA-256":
+		if saslConfig.ScramUsername == "" || saslConfig.ScramPassword == "" {
+			return nil, fmt.Errorf("username and password have to be provided for sasl mechanism SCRAM-SHA-256")
+		}
+		return scram.Mechanism(scram.SHA256, saslConfig.ScramUsername, saslConfig.ScramPassword)
+	case "SCRAM-SHA-512":
+		if saslConfig.ScramUsername == "" || saslConfig.ScramPassword == "" {
+			return nil, fmt.Errorf("username and password have to be provided for sasl mechanism SCRAM-SHA-512")
+		}
+		return scram.Mechanism(scram.SHA512, saslConfig.ScramUsername, saslConfig.ScramPassword)
+	case "OAUTHBEARER":
+		provider, err := newTokenProvider(saslConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &oauthBearerMechanism{provider: provider}, nil
+	default:
+		return nil, fmt.Errorf("unsupported sasl mechanism %q, supported: PLAIN, SCRAM-SHA-256, SCRAM-SHA-512, OAUTHBEARER", saslConfig.SaslMechanism)
+	}
+}
+
+func newTokenProvider(saslConfig *KafkaSaslConfig) (TokenProvider, error) {
+	switch strings.ToLower(saslConfig.OauthTokenProvider) {
+	case "", "static":
+		token := saslConfig.OauthStaticToken
+		if token == "" && saslConfig.OauthStaticTokenEnv != "" {
+			token = os.Getenv(saslConfig.OauthStaticTokenEnv)
+		}
+		if token == "" {
+			return nil, fmt.Errorf("OauthStaticToken or OauthStaticTokenEnv has to be set for the static token provider")
+		}
+		return &staticTokenProvider{token: token}, nil
+	case "oidc":
+		if saslConfig.OauthTokenURL == "" || saslConfig.OauthClientID == "" || saslConfig.OauthClientSecret == "" {
+			return nil, fmt.Errorf("OauthTokenURL, OauthClientID and OauthClientSecret have to be set for the oidc token provider")
+		}
+		refreshBefore := saslConfig.OauthRefreshBefore
+		if refreshBefore <= 0 {
+			refreshBefore = 30 * time.Second
+		}
+		return &oidcTokenProvider{
+			tokenURL:      saslConfig.OauthTokenURL,
+			clientID:      saslConfig.OauthClientID,
+			clientSecret:  saslConfig.OauthClientSecret,
+			scope:         saslConfig.OauthScope,
+			refreshBefore: refreshBefore,
+			httpClient:    &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported oauth token provider %q, supported: static, oidc", saslConfig.OauthTokenProvider)
+	}
+}
+
+// staticTokenProvider always returns the same pre-configured token.
+type staticTokenProvider struct {
+	token string
+}
+
+func (p *staticTokenProvider) Token(_ context.Context) (string, error) {
+	return p.token, nil
+}
+
+// oidcTokenProvider implements the OAuth2 client_credentials grant, caching
+// the token until shortly before it expires and refreshing it transparently
+// on the next call.
+type oidcTokenProvider struct {
+	tokenURL      string
+	clientID      string
+	clientSecret  string
+	scope         string
+	refreshBefore time.Duration
+	httpClient    *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func (p *oidcTokenProvider) Token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != "" && time.Now().Before(p.expiresAt.Add(-p.refreshBefore)) {
+		return p.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", p.clientID)
+	form.Set("client_secret", p.clientSecret)
+	if p.scope != "" {
+		form.Set("scope", p.scope)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("cannot build oidc token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc token endpoint returned status %d", resp.StatusCode)
+	}
+
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", fmt.Errorf("cannot decode oidc token response: %w", err)
+	}
+	if payload.AccessToken == "" {
+		return "", fmt.Errorf("oidc token response did not contain an access_token")
+	}
+
+	p.token = payload.AccessToken
+	if payload.ExpiresIn > 0 {
+		p.expiresAt = time.Now().Add(time.Duration(payload.ExpiresIn) * time.Second)
+	} else {
+		p.expiresAt = time.Now().Add(p.refreshBefore)
+	}
+
+	return p.token, nil
+}
+
+// oauthBearerMechanism implements sasl.Mechanism for SASL/OAUTHBEARER
+// (RFC 7628), sourcing the bearer token from a TokenProvider on every
+// authentication attempt.
+type oauthBearerMechanism struct {
+	provider TokenProvider
+}
+
+func (m *oauthBearerMechanism) Name() string {
+	return "OAUTHBEARER"
+}
+
+func (m *oauthBearerMechanism) Start(ctx context.Context) (sasl.StateMachine, []byte, error) {
+	token, err := m.provider.Token(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot obtain oauth token: %w", err)
+	}
+
+	msg := fmt.Sprintf("n,,\x01auth=Bearer %s\x01\x01", token)
+	return &oauthBearerSession{}, []byte(msg), nil
+}
+
+// oauthBearerSession has no further round trips in the success case; a
+// non-empty challenge indicates the broker rejected the token.
+type oauthBearerSession struct{}
+
+func (s *oauthBearerSession) Next(_ context.Context, challenge []byte) (bool, []byte, error) {
+	if len(challenge) > 0 {
+		return false, nil, fmt.Errorf("oauthbearer authentication failed: %s", string(challenge))
+	}
+	return true, nil, nil
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	kafka "github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	spoolSegmentPrefix  = "segment-"
+	spoolSegmentSuffix  = ".jsonl"
+	defaultSegmentBytes = 8 * 1024 * 1024
+	defaultMinBackoff   = 1 * time.Second
+	defaultMaxBackoff   = 1 * time.Minute
+	// defaultActiveSegmentIdleTimeout bounds how long a small, never-rotated
+	// active segment can sit undrained: a short outage rarely spools enough
+	// to hit SegmentMaxBytes on its own.
+	defaultActiveSegmentIdleTimeout = 5 * time.Second
+)
+
+var errSpoolFull = fmt.Errorf("spool is full")
+
+type (
+	// SpoolConfig configures the on-disk write-ahead queue used to survive
+	// Kafka outages without dropping notifications.
+	SpoolConfig struct {
+		// Dir is the directory segment files are written to. Required.
+		Dir string
+		// MaxBytes bounds the total on-disk size of the spool. Writes beyond
+		// this bound fail with errSpoolFull instead of growing forever.
+		MaxBytes int64
+		// SegmentMaxBytes rotates to a new segment file once the active one
+		// grows past this size. Defaults to defaultSegmentBytes.
+		SegmentMaxBytes int64
+		// MinBackoff/MaxBackoff bound the exponential backoff applied
+		// between drain attempts while Kafka stays unavailable.
+		MinBackoff time.Duration
+		MaxBackoff time.Duration
+		// ActiveSegmentIdleTimeout controls how long the segment currently
+		// being appended to can sit without a new Enqueue before drainOnce
+		// closes and rotates it, so its messages become drainable even
+		// though it never reached SegmentMaxBytes. Defaults to
+		// defaultActiveSegmentIdleTimeout.
+		ActiveSegmentIdleTimeout time.Duration
+	}
+
+	// spooledMessage is the on-disk representation of one queued Kafka
+	// message. GroupKey carries AlertmanagerEntry.GroupKey so that replay
+	// can be reasoned about per alert group, even though segments are
+	// replayed strictly in enqueue order, which already preserves
+	// per-group ordering as a special case of global ordering.
+	spooledMessage struct {
+		GroupKey   string    `json:"groupKey"`
+		Topic      string    `json:"topic"`
+		Key        []byte    `json:"key,omitempty"`
+		Value      []byte    `json:"value"`
+		EnqueuedAt time.Time `json:"enqueuedAt"`
+	}
+
+	diskSpool struct {
+		cfg SpoolConfig
+
+		mu        sync.Mutex
+		size      int64
+		writeFile *os.File
+		writeSeq  int
+		lastWrite time.Time
+
+		flush chan struct{}
+	}
+)
+
+// newDiskSpool opens (creating if necessary) cfg.Dir and continues segment
+// numbering after its newest segment (the first Enqueue opens a fresh
+// segment rather than appending to an existing one), recomputing the tracked
+// on-disk size from whatever segments are already there.
+func newDiskSpool(cfg SpoolConfig) (*diskSpool, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("spool directory must be set")
+	}
+	if cfg.SegmentMaxBytes <= 0 {
+		cfg.SegmentMaxBytes = defaultSegmentBytes
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = defaultMinBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	if cfg.ActiveSegmentIdleTimeout <= 0 {
+		cfg.ActiveSegmentIdleTimeout = defaultActiveSegmentIdleTimeout
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("cannot create spool directory %s: %w", cfg.Dir, err)
+	}
+
+	s := &diskSpool{cfg: cfg, flush: make(chan struct{}, 1)}
+
+	segments, err := s.segmentPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	maxSeq := 0
+	for _, path := range segments {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot stat spool segment %s: %w", path, err)
+		}
+		total += info.Size()
+
+		var seq int
+		if _, err := fmt.Sscanf(filepath.Base(path), spoolSegmentPrefix+"%d"+spoolSegmentSuffix, &seq); err == nil && seq > maxSeq {
+			maxSeq = seq
+		}
+	}
+	s.size = total
+	s.writeSeq = maxSeq
+
+	return s, nil
+}
+
+func (s *diskSpool) segmentPath(seq int) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("%s%08d%s", spoolSegmentPrefix, seq, spoolSegmentSuffix))
+}
+
+func (s *diskSpool) segmentPaths() ([]string, error) {
+	entries, err := os.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read spool directory %s: %w", s.cfg.Dir, err)
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		paths = append(paths, filepath.Join(s.cfg.Dir, entry.Name()))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Enqueue appends msg to the active segment, fsyncing before returning so a
+// crash right after a 202 response can't silently lose the notification.
+func (s *diskSpool) Enqueue(msg spooledMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("cannot marshal spooled message: %w", err)
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cfg.MaxBytes > 0 && s.size+int64(len(data)) > s.cfg.MaxBytes {
+		return errSpoolFull
+	}
+
+	if s.writeFile == nil {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.writeFile.Write(data)
+	if err != nil {
+		return fmt.Errorf("cannot append to spool segment: %w", err)
+	}
+	s.size += int64(n)
+	s.lastWrite = time.Now()
+
+	if err := s.writeFile.Sync(); err != nil {
+		return fmt.Errorf("cannot fsync spool segment: %w", err)
+	}
+
+	if info, err := s.writeFile.Stat(); err == nil && info.Size() >= s.cfg.SegmentMaxBytes {
+		if err := s.writeFile.Close(); err != nil {
+			return fmt.Errorf("cannot close full spool segment: %w", err)
+		}
+		s.writeFile = nil
+	}
+
+	select {
+	case s.flush <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (s *diskSpool) rotateLocked() error {
+	s.writeSeq++
+	f, err := os.OpenFile(s.segmentPath(s.writeSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("cannot open spool segment: %w", err)
+	}
+	s.writeFile = f
+	return nil
+}
+
+// Size reports the tracked on-disk size of the spool in bytes.
+func (s *diskSpool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// OldestAge reports how long the oldest still-queued message has been
+// waiting, or zero if the spool is empty.
+func (s *diskSpool) OldestAge() time.Duration {
+	segments, err := s.segmentPaths()
+	if err != nil || len(segments) == 0 {
+		return 0
+	}
+
+	f, err := os.Open(segments[0])
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	if !scanner.Scan() {
+		return 0
+	}
+
+	var msg spooledMessage
+	if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+		return 0
+	}
+
+	return time.Since(msg.EnqueuedAt)
+}
+
+// drainOnce replays every segment in order, oldest first, handing each
+// message to write. It stops at the first failure, leaving the offending
+// message and everything after it in place for the next attempt, and
+// reports how many messages were successfully replayed.
+func (s *diskSpool) drainOnce(write func(spooledMessage) error) (int, error) {
+	s.closeIdleActiveSegment()
+
+	segments, err := s.segmentPaths()
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for _, path := range segments {
+		s.mu.Lock()
+		active := s.writeFile != nil && path == s.segmentPath(s.writeSeq)
+		s.mu.Unlock()
+		if active {
+			// Never drain the segment still being appended to; it will be
+			// picked up once rotated (on size or idle timeout) or on the
+			// next pass after it is closed.
+			continue
+		}
+
+		n, err := s.drainSegment(path, write)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+
+	return replayed, nil
+}
+
+// closeIdleActiveSegment closes the segment currently being appended to if
+// it has not received a write in ActiveSegmentIdleTimeout, so a short outage
+// that never spools enough to hit SegmentMaxBytes still gets drained instead
+// of sitting on disk indefinitely. The next Enqueue transparently rotates to
+// a fresh segment.
+func (s *diskSpool) closeIdleActiveSegment() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writeFile == nil || time.Since(s.lastWrite) < s.cfg.ActiveSegmentIdleTimeout {
+		return
+	}
+
+	if err := s.writeFile.Close(); err != nil {
+		log.Warnf("cannot close idle spool segment: %s", err)
+		return
+	}
+	s.writeFile = nil
+}
+
+func (s *diskSpool) drainSegment(path string, write func(spooledMessage) error) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("cannot open spool segment %s: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+
+	replayed := 0
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+
+		var msg spooledMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			log.Warnf("dropping unreadable spool record in %s: %s", path, err)
+			continue
+		}
+
+		if err := write(msg); err != nil {
+			if reqErr := s.requeueRemainder(path, line, scanner); reqErr != nil {
+				return replayed, fmt.Errorf("cannot requeue after write failure: %w (write error: %s)", reqErr, err)
+			}
+			// Propagate the write error, not requeueRemainder's (nil, on
+			// success), so drainOnce actually stops at this segment instead
+			// of draining everything after it out of order.
+			return replayed, err
+		}
+		replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		return replayed, fmt.Errorf("cannot read spool segment %s: %w", path, err)
+	}
+
+	return replayed, s.removeSegmentLocked(path)
+}
+
+// requeueRemainder rewrites path to contain failedLine followed by whatever
+// the scanner has not yet consumed, so the failed message is retried first
+// on the next drain attempt.
+func (s *diskSpool) requeueRemainder(path string, failedLine []byte, scanner *bufio.Scanner) error {
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("cannot create spool requeue file: %w", err)
+	}
+
+	if _, err := out.Write(append(failedLine, '\n')); err != nil {
+		out.Close()
+		return fmt.Errorf("cannot requeue failed spool message: %w", err)
+	}
+	for scanner.Scan() {
+		if _, err := out.Write(append(append([]byte(nil), scanner.Bytes()...), '\n')); err != nil {
+			out.Close()
+			return fmt.Errorf("cannot requeue remaining spool messages: %w", err)
+		}
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return fmt.Errorf("cannot fsync spool requeue file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("cannot close spool requeue file: %w", err)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (s *diskSpool) removeSegmentLocked(path string) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		s.mu.Lock()
+		s.size -= info.Size()
+		s.mu.Unlock()
+	}
+	return os.Remove(path)
+}
+
+// RunDrainLoop replays the spool into write, retrying with exponential
+// backoff and jitter while write keeps failing (i.e. Kafka is still
+// unavailable), and waking up immediately whenever Enqueue or TriggerFlush
+// signal there may be new work. It only returns once ctx is cancelled; run
+// it in its own goroutine.
+func (s *diskSpool) RunDrainLoop(ctx context.Context, write func(spooledMessage) error, onReplayed func(int)) {
+	backoff := s.cfg.MinBackoff
+
+	for {
+		replayed, err := s.drainOnce(write)
+		if onReplayed != nil && replayed > 0 {
+			onReplayed(replayed)
+		}
+
+		if err != nil {
+			log.Warnf("spool drain paused: %s", err)
+			backoff = nextBackoff(backoff, s.cfg.MaxBackoff)
+		} else {
+			backoff = s.cfg.MinBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.flush:
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// TriggerFlush wakes up RunDrainLoop immediately instead of waiting out the
+// current backoff. It backs the /spool/flush admin endpoint.
+func (s *diskSpool) TriggerFlush() {
+	select {
+	case s.flush <- struct{}{}:
+	default:
+	}
+}
+
+func nextBackoff(current, max time.Duration) time.Duration {
+	next := current * 2
+	if next > max {
+		next = max
+	}
+	jitter := time.Duration(rand.Int63n(int64(next)/2 + 1))
+	return next/2 + jitter
+}
+
+// EnableSpool wires a disk-backed write-ahead spool into the exporter: a
+// write failure in HttpHandler is persisted here instead of being dropped,
+// and a background goroutine keeps retrying delivery until Kafka is back.
+func (e *AlertmanagerKafkaExporter) EnableSpool(cfg SpoolConfig) error {
+	spool, err := newDiskSpool(cfg)
+	if err != nil {
+		return err
+	}
+	e.spool = spool
+
+	e.prometheus.alertsSpooled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alertmanager2kafka_alerts_spooled",
+			Help: "alertmanager2kafka alerts written to the on-disk spool after a Kafka write failure",
+		},
+		[]string{},
+	)
+	prometheus.MustRegister(e.prometheus.alertsSpooled)
+
+	e.prometheus.alertsReplayed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alertmanager2kafka_alerts_replayed",
+			Help: "alertmanager2kafka alerts successfully replayed from the on-disk spool",
+		},
+		[]string{},
+	)
+	prometheus.MustRegister(e.prometheus.alertsReplayed)
+
+	e.prometheus.alertsDroppedSpoolFull = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alertmanager2kafka_alerts_dropped_spool_full",
+			Help: "alertmanager2kafka alerts dropped because the on-disk spool was full",
+		},
+		[]string{},
+	)
+	prometheus.MustRegister(e.prometheus.alertsDroppedSpoolFull)
+
+	e.prometheus.spoolSizeBytes = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "alertmanager2kafka_spool_size_bytes",
+			Help: "alertmanager2kafka current on-disk size of the spool in bytes",
+		},
+		func() float64 { return float64(spool.Size()) },
+	)
+	prometheus.MustRegister(e.prometheus.spoolSizeBytes)
+
+	e.prometheus.spoolAgeSeconds = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "alertmanager2kafka_spool_age_seconds",
+			Help: "alertmanager2kafka age in seconds of the oldest message still queued in the spool",
+		},
+		func() float64 { return spool.OldestAge().Seconds() },
+	)
+	prometheus.MustRegister(e.prometheus.spoolAgeSeconds)
+
+	go spool.RunDrainLoop(context.Background(), e.writeToKafka, func(n int) {
+		e.prometheus.alertsReplayed.WithLabelValues().Add(float64(n))
+	})
+
+	return nil
+}
+
+// spoolMessages persists messages to the spool after a Kafka write failure.
+// It is not all-or-nothing: if the spool fills up partway through, whatever was
+// already appended stays (it will simply be replayed alongside the rest),
+// and the error is returned so the caller knows delivery could not be
+// guaranteed at all.
+func (e *AlertmanagerKafkaExporter) spoolMessages(groupKey string, messages []kafka.Message) error {
+	for _, m := range messages {
+		err := e.spool.Enqueue(spooledMessage{
+			GroupKey:   groupKey,
+			Topic:      m.Topic,
+			Key:        m.Key,
+			Value:      m.Value,
+			EnqueuedAt: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		e.prometheus.alertsSpooled.WithLabelValues().Inc()
+	}
+	return nil
+}
+
+// writeToKafka replays a single spooled message back into Kafka.
+func (e *AlertmanagerKafkaExporter) writeToKafka(msg spooledMessage) error {
+	return e.kafkaWriter.WriteMessages(context.Background(), kafka.Message{
+		Topic: msg.Topic,
+		Key:   msg.Key,
+		Value: msg.Value,
+	})
+}
+
+// SpoolFlushHandler is an admin endpoint that nudges the background drain
+// loop to retry immediately instead of waiting out its current backoff.
+func (e *AlertmanagerKafkaExporter) SpoolFlushHandler(w http.ResponseWriter, r *http.Request) {
+	if e.spool == nil {
+		http.Error(w, "spool is not enabled", http.StatusNotFound)
+		return
+	}
+	e.spool.TriggerFlush()
+	w.WriteHeader(http.StatusAccepted)
+}
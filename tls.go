@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultTLSReloadInterval = 30 * time.Second
+
+// tlsReloader keeps the client key pair and CA bundle used by ConnectKafka
+// fresh by re-reading them from disk on a timer. This lets the exporter
+// survive cert-manager rotations and short-lived internal CA certs without a
+// process restart, since short-lived Kafka TLS certs can't tolerate a
+// load-once-at-startup dialer.
+type tlsReloader struct {
+	certFile string
+	keyFile  string
+
+	caCertFile string
+	caCertDir  string
+
+	serverName string
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	roots       *x509.CertPool
+	certModTime time.Time
+	keyModTime  time.Time
+	caModTime   time.Time
+}
+
+// newTLSReloader loads the initial key pair (if certFile/keyFile are set)
+// and CA bundle and returns a reloader ready to be handed to Start. Leaving
+// certFile/keyFile empty is valid for SASL_SSL deployments that
+// authenticate over TLS without a client certificate; GetClientCertificate
+// then simply has nothing to offer.
+func newTLSReloader(certFile, keyFile, caCertFile, caCertDir, serverName string) (*tlsReloader, error) {
+	r := &tlsReloader{
+		certFile:   certFile,
+		keyFile:    keyFile,
+		caCertFile: caCertFile,
+		caCertDir:  caCertDir,
+		serverName: serverName,
+	}
+
+	if certFile != "" || keyFile != "" {
+		if err := r.reloadCert(); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.reloadCA(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Start polls the configured files for changes every interval and reloads
+// them in place until ctx is cancelled. Run it in its own goroutine.
+func (r *tlsReloader) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultTLSReloadInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if r.certFile != "" || r.keyFile != "" {
+			if changed, err := r.certFilesChanged(); err != nil {
+				log.Warnf("cannot stat TLS key pair for reload: %s", err)
+			} else if changed {
+				if err := r.reloadCert(); err != nil {
+					log.Warnf("cannot reload TLS key pair: %s", err)
+				} else {
+					log.Infof("reloaded TLS key pair (key=%s, cert=%s)", r.keyFile, r.certFile)
+				}
+			}
+		}
+
+		if changed, err := r.caFilesChanged(); err != nil {
+			log.Warnf("cannot stat CA bundle for reload: %s", err)
+		} else if changed {
+			if err := r.reloadCA(); err != nil {
+				log.Warnf("cannot reload CA bundle: %s", err)
+			} else {
+				log.Infof("reloaded CA bundle (cacert=%s, cacertdir=%s)", r.caCertFile, r.caCertDir)
+			}
+		}
+	}
+}
+
+func (r *tlsReloader) certFilesChanged() (bool, error) {
+	certMod, err := fileModTime(r.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyMod, err := fileModTime(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	changed := !certMod.Equal(r.certModTime) || !keyMod.Equal(r.keyModTime)
+	r.mu.RUnlock()
+
+	return changed, nil
+}
+
+func (r *tlsReloader) reloadCert() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load SSL key/certificate pair (key=%s, cert=%s): %w", r.keyFile, r.certFile, err)
+	}
+
+	certMod, err := fileModTime(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyMod, err := fileModTime(r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.certModTime = certMod
+	r.keyModTime = keyMod
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *tlsReloader) caFilesChanged() (bool, error) {
+	mod, err := caBundleModTime(r.caCertFile, r.caCertDir)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	changed := !mod.Equal(r.caModTime)
+	r.mu.RUnlock()
+
+	return changed, nil
+}
+
+func (r *tlsReloader) reloadCA() error {
+	pool, err := loadCABundle(r.caCertFile, r.caCertDir)
+	if err != nil {
+		return err
+	}
+
+	mod, err := caBundleModTime(r.caCertFile, r.caCertDir)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.roots = pool
+	r.caModTime = mod
+	r.mu.Unlock()
+
+	return nil
+}
+
+// GetClientCertificate backs tls.Config.GetClientCertificate, always
+// returning the most recently loaded key pair, or an empty certificate (so
+// none is sent) when no key pair is configured.
+func (r *tlsReloader) GetClientCertificate(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return r.cert, nil
+}
+
+// VerifyPeerCertificate backs tls.Config.VerifyPeerCertificate and performs
+// the verification tls.Config would normally do itself, against the most
+// recently loaded CA bundle. It is required because, unlike client
+// certificates, crypto/tls has no hook to source RootCAs dynamically per
+// handshake; the caller must set InsecureSkipVerify and delegate to this
+// function instead. The hostname is checked against the configured
+// serverName only: when serverName is empty, the chain is verified but no
+// hostname check is made.
+func (r *tlsReloader) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no peer certificate presented")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("cannot parse peer certificate: %w", err)
+		}
+		certs[i] = cert
+	}
+
+	r.mu.RLock()
+	roots := r.roots
+	r.mu.RUnlock()
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       r.serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return fmt.Errorf("peer certificate verification failed: %w", err)
+	}
+
+	return nil
+}
+
+func fileModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot stat %s: %w", path, err)
+	}
+	return info.ModTime(), nil
+}
+
+// caBundleModTime returns the most recent mtime across either the single CA
+// file or every entry of the CA directory, whichever is configured.
+func caBundleModTime(caCertFile, caCertDir string) (time.Time, error) {
+	if caCertDir != "" {
+		entries, err := ioutil.ReadDir(caCertDir)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("cannot read CA certificate directory %s: %w", caCertDir, err)
+		}
+
+		var latest time.Time
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			if entry.ModTime().After(latest) {
+				latest = entry.ModTime()
+			}
+		}
+		return latest, nil
+	}
+
+	return fileModTime(caCertFile)
+}
+
+// loadCABundle builds a CertPool from either a single PEM file or every file
+// in a directory of PEM files.
+func loadCABundle(caCertFile, caCertDir string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+
+	if caCertDir != "" {
+		entries, err := ioutil.ReadDir(caCertDir)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA certificate directory %s: %w", caCertDir, err)
+		}
+
+		loaded := 0
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(caCertDir, entry.Name())
+			pem, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read CA certificate file %s: %w", path, err)
+			}
+			if pool.AppendCertsFromPEM(pem) {
+				loaded++
+			}
+		}
+		if loaded == 0 {
+			return nil, fmt.Errorf("no usable CA certificates found in directory %s", caCertDir)
+		}
+		return pool, nil
+	}
+
+	pem, err := ioutil.ReadFile(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read SSL CA certificate file %s: %w", caCertFile, err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("cannot load SSL CA certificates from file %s", caCertFile)
+	}
+
+	return pool, nil
+}
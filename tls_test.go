@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestKeyPair writes a throwaway self-signed EC certificate/key pair
+// into dir, distinguishable across calls by serial.
+func writeTestKeyPair(t *testing.T, dir, certName, keyName string, serial int64) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "alertmanager2kafka-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %s", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, certName), certPEM, 0o600); err != nil {
+		t.Fatalf("cannot write cert: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %s", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, keyName), keyPEM, 0o600); err != nil {
+		t.Fatalf("cannot write key: %s", err)
+	}
+}
+
+// TestTLSReloaderPicksUpRotatedKeyPair swaps the key pair on disk while
+// tlsReloader.Start is polling in the background and verifies
+// GetClientCertificate starts returning the new certificate, without
+// restarting the reloader.
+func TestTLSReloaderPicksUpRotatedKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "tls.crt")
+	keyPath := filepath.Join(dir, "tls.key")
+	caPath := filepath.Join(dir, "ca.crt")
+
+	writeTestKeyPair(t, dir, "tls.crt", "tls.key", 1)
+	writeTestKeyPair(t, dir, "ca.crt", "ca.key", 2)
+
+	reloader, err := newTLSReloader(certPath, keyPath, caPath, "", "")
+	if err != nil {
+		t.Fatalf("newTLSReloader: %s", err)
+	}
+
+	first, err := reloader.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetClientCertificate: %s", err)
+	}
+	firstLeaf, err := x509.ParseCertificate(first.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse initial cert: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go reloader.Start(ctx, 20*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	writeTestKeyPair(t, dir, "tls.crt", "tls.key", 3)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cert, err := reloader.GetClientCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetClientCertificate: %s", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("parse reloaded cert: %s", err)
+		}
+		if leaf.SerialNumber.Cmp(firstLeaf.SerialNumber) != 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("reloader did not pick up the rotated key pair before the deadline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"text/template"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+type (
+	// Transformer turns a received AlertmanagerEntry into zero or more Kafka
+	// messages. Returning zero messages means the entry was filtered out and
+	// nothing should be written. Implementations other than
+	// pipelineTransformer can plug in alternative wire formats (e.g. a
+	// CloudEvents envelope) by being assigned to
+	// AlertmanagerKafkaExporter.transformer.
+	Transformer interface {
+		Transform(entry AlertmanagerEntry) ([]kafka.Message, error)
+	}
+
+	// TransformConfig configures the default pipelineTransformer: optional
+	// one-message-per-alert fan-out, key derivation, label/annotation based
+	// topic routing, allow/drop filters and label redaction/renaming.
+	TransformConfig struct {
+		// DefaultTopic is used when no Route matches.
+		DefaultTopic string
+
+		// FanOut splits a single webhook call into one Kafka message per
+		// alert instead of one message for the whole group.
+		FanOut bool
+
+		// KeyTemplate is a text/template string evaluated against a
+		// message's Labels/Annotations to produce Message.Key. Left empty,
+		// messages carry no key.
+		KeyTemplate string
+
+		// Routes are evaluated in order; the first one whose label and
+		// annotation patterns all match wins. MatchLabels/MatchAnnotations
+		// values are regular expressions matched against the label value.
+		Routes []RouteRule
+
+		// Allow, if non-empty, requires a message to match at least one rule
+		// to be kept. Drop rules are evaluated first and always exclude a
+		// matching message, regardless of Allow.
+		Allow []FilterRule
+		Drop  []FilterRule
+
+		// RedactLabels removes the named labels before a message is built.
+		RedactLabels []string
+		// RenameLabels renames label keys (old -> new) before a message is
+		// built. Renaming happens after redaction.
+		RenameLabels map[string]string
+	}
+
+	RouteRule struct {
+		MatchLabels      map[string]string
+		MatchAnnotations map[string]string
+		Topic            string
+	}
+
+	FilterRule struct {
+		MatchLabels      map[string]string
+		MatchAnnotations map[string]string
+	}
+
+	// templateContext is the dot-value exposed to KeyTemplate.
+	templateContext struct {
+		Labels      map[string]string
+		Annotations map[string]string
+		Status      string
+	}
+
+	compiledRouteRule struct {
+		labels      map[string]*regexp.Regexp
+		annotations map[string]*regexp.Regexp
+		topic       string
+	}
+
+	compiledFilterRule struct {
+		labels      map[string]*regexp.Regexp
+		annotations map[string]*regexp.Regexp
+	}
+
+	pipelineTransformer struct {
+		cfg         TransformConfig
+		keyTemplate *template.Template
+		routes      []compiledRouteRule
+		allow       []compiledFilterRule
+		drop        []compiledFilterRule
+	}
+)
+
+// NewPipelineTransformer compiles cfg into a Transformer. It fails fast on
+// invalid regexes or templates so misconfiguration is caught at startup
+// rather than on the first webhook call.
+func NewPipelineTransformer(cfg TransformConfig) (*pipelineTransformer, error) {
+	t := &pipelineTransformer{cfg: cfg}
+
+	if cfg.KeyTemplate != "" {
+		tmpl, err := template.New("key").Parse(cfg.KeyTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KeyTemplate: %w", err)
+		}
+		t.keyTemplate = tmpl
+	}
+
+	for _, rule := range cfg.Routes {
+		compiled, err := compileRoute(rule)
+		if err != nil {
+			return nil, err
+		}
+		t.routes = append(t.routes, compiled)
+	}
+
+	for _, rule := range cfg.Allow {
+		compiled, err := compileFilter(rule)
+		if err != nil {
+			return nil, err
+		}
+		t.allow = append(t.allow, compiled)
+	}
+
+	for _, rule := range cfg.Drop {
+		compiled, err := compileFilter(rule)
+		if err != nil {
+			return nil, err
+		}
+		t.drop = append(t.drop, compiled)
+	}
+
+	return t, nil
+}
+
+func compileRoute(rule RouteRule) (compiledRouteRule, error) {
+	labels, err := compilePatterns(rule.MatchLabels)
+	if err != nil {
+		return compiledRouteRule{}, err
+	}
+	annotations, err := compilePatterns(rule.MatchAnnotations)
+	if err != nil {
+		return compiledRouteRule{}, err
+	}
+	return compiledRouteRule{labels: labels, annotations: annotations, topic: rule.Topic}, nil
+}
+
+func compileFilter(rule FilterRule) (compiledFilterRule, error) {
+	labels, err := compilePatterns(rule.MatchLabels)
+	if err != nil {
+		return compiledFilterRule{}, err
+	}
+	annotations, err := compilePatterns(rule.MatchAnnotations)
+	if err != nil {
+		return compiledFilterRule{}, err
+	}
+	return compiledFilterRule{labels: labels, annotations: annotations}, nil
+}
+
+func compilePatterns(patterns map[string]string) (map[string]*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	compiled := make(map[string]*regexp.Regexp, len(patterns))
+	for key, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q for %q: %w", pattern, key, err)
+		}
+		compiled[key] = re
+	}
+	return compiled, nil
+}
+
+// Transform implements Transformer. With FanOut disabled it emits a single
+// message for the whole group, keyed/routed/filtered off CommonLabels (the
+// labels shared by every alert in the notification, not just the typically
+// much smaller set Alertmanager grouped by). With FanOut enabled it emits
+// one message per alert, keyed/routed/filtered off
+// that alert's own labels, so that differently-labeled alerts in the same
+// group can land on different partitions or topics. Either way,
+// RedactLabels/RenameLabels are applied to every label map that ends up in
+// the marshaled payload (CommonLabels, GroupLabels and each alert's Labels),
+// not just the one used for key/route/filter matching.
+func (t *pipelineTransformer) Transform(entry AlertmanagerEntry) ([]kafka.Message, error) {
+	out := entry
+	out.GroupLabels = applyRedactAndRename(entry.GroupLabels, t.cfg.RedactLabels, t.cfg.RenameLabels)
+	out.CommonLabels = applyRedactAndRename(entry.CommonLabels, t.cfg.RedactLabels, t.cfg.RenameLabels)
+	out.Alerts = append(entry.Alerts[:0:0], entry.Alerts...)
+	for i := range out.Alerts {
+		out.Alerts[i].Labels = applyRedactAndRename(out.Alerts[i].Labels, t.cfg.RedactLabels, t.cfg.RenameLabels)
+	}
+
+	if !t.cfg.FanOut {
+		return t.buildMessages(out, out.CommonLabels, entry.CommonAnnotations, entry.Status)
+	}
+
+	var messages []kafka.Message
+	for _, alert := range out.Alerts {
+		perAlert := out
+		perAlert.Alerts = append(out.Alerts[:0:0], alert)
+
+		msgs, err := t.buildMessages(perAlert, alert.Labels, alert.Annotations, alert.Status)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msgs...)
+	}
+
+	return messages, nil
+}
+
+func (t *pipelineTransformer) buildMessages(entry AlertmanagerEntry, labels, annotations map[string]string, status string) ([]kafka.Message, error) {
+	if matchesAny(t.drop, labels, annotations) {
+		return nil, nil
+	}
+	if len(t.allow) > 0 && !matchesAny(t.allow, labels, annotations) {
+		return nil, nil
+	}
+
+	key, err := t.renderKey(labels, annotations, status)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal alert entry: %w", err)
+	}
+
+	return []kafka.Message{{
+		Topic: t.resolveTopic(labels, annotations),
+		Key:   key,
+		Value: payload,
+	}}, nil
+}
+
+func (t *pipelineTransformer) renderKey(labels, annotations map[string]string, status string) ([]byte, error) {
+	if t.keyTemplate == nil {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	ctx := templateContext{Labels: labels, Annotations: annotations, Status: status}
+	if err := t.keyTemplate.Execute(&buf, ctx); err != nil {
+		return nil, fmt.Errorf("cannot render KeyTemplate: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (t *pipelineTransformer) resolveTopic(labels, annotations map[string]string) string {
+	for _, route := range t.routes {
+		if matches(route.labels, labels) && matches(route.annotations, annotations) {
+			return route.topic
+		}
+	}
+	return t.cfg.DefaultTopic
+}
+
+func matchesAny(rules []compiledFilterRule, labels, annotations map[string]string) bool {
+	for _, rule := range rules {
+		if matches(rule.labels, labels) && matches(rule.annotations, annotations) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether every configured pattern has a matching value in
+// values. An empty pattern set always matches.
+func matches(patterns map[string]*regexp.Regexp, values map[string]string) bool {
+	for key, re := range patterns {
+		if !re.MatchString(values[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+func applyRedactAndRename(labels map[string]string, redact []string, rename map[string]string) map[string]string {
+	if len(redact) == 0 && len(rename) == 0 {
+		return labels
+	}
+
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+	for _, key := range redact {
+		delete(out, key)
+	}
+	for from, to := range rename {
+		if v, ok := out[from]; ok {
+			delete(out, from)
+			out[to] = v
+		}
+	}
+	return out
+}